@@ -0,0 +1,256 @@
+// Package cache 提供 qcdn 代理用的本地资源缓存：一个可插拔的 Cache 接口和一个基于
+// 文件系统、按 LRU 淘汰的默认实现。
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache 是可插拔的资源缓存接口。QcdnProxy 命中缓存时不再请求任何源站，未命中时把
+// 源站响应写入缓存供下次使用。
+type Cache interface {
+	// Get 返回 key 对应的缓存内容和响应头；ok 为 false 表示未命中或已过期。
+	Get(key string) (body io.ReadCloser, header http.Header, ok bool)
+	// Put 把 header/body 写入缓存，key 要与 Get 用的一致。
+	Put(key string, header http.Header, body io.Reader) error
+	// Delete 删除 key 对应的缓存项，不存在时是个空操作。
+	Delete(key string)
+}
+
+// storedMeta 是和数据文件配套的 sidecar JSON，记录响应头、大小和据此算出的过期时间。
+type storedMeta struct {
+	Header    http.Header
+	Size      int64
+	ExpiresAt time.Time
+}
+
+type lruEntry struct {
+	hash string
+	size int64
+}
+
+// FS 是默认的文件系统 Cache 实现：每个资源按 sha256(key) 存成一个数据文件和一个同名
+// 加 .json 后缀的 sidecar 头文件，根据 Cache-Control/Expires 判断新鲜度，总大小超过
+// MaxBytes 时按最久未使用（LRU）淘汰。
+type FS struct {
+	Dir      string
+	MaxBytes int64 // <= 0 表示不限制
+
+	mutex   sync.Mutex
+	lru     *list.List
+	index   map[string]*list.Element
+	curSize int64
+}
+
+// NewFS 打开（或创建）dir 作为缓存目录，扫描其中已有的缓存项以恢复 LRU 顺序和总大小。
+func NewFS(dir string, maxBytes int64) *FS {
+	c := &FS{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		lru:      list.New(),
+		index:    make(map[string]*list.Element),
+	}
+	c.loadExisting()
+	return c
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *FS) dataPath(hash string) string   { return filepath.Join(c.Dir, hash) }
+func (c *FS) headerPath(hash string) string { return filepath.Join(c.Dir, hash+".json") }
+
+func (c *FS) loadExisting() {
+	files, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return
+	}
+	type found struct {
+		hash    string
+		size    int64
+		modTime time.Time
+	}
+	var all []found
+	for _, de := range files {
+		hash, ok := strings.CutSuffix(de.Name(), ".json")
+		if !ok {
+			continue
+		}
+		meta, ok := c.readMeta(hash)
+		if !ok {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		all = append(all, found{hash, meta.Size, info.ModTime()})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime.Before(all[j].modTime) })
+	for _, f := range all {
+		el := c.lru.PushFront(&lruEntry{hash: f.hash, size: f.size})
+		c.index[f.hash] = el
+		c.curSize += f.size
+	}
+}
+
+func (c *FS) readMeta(hash string) (storedMeta, bool) {
+	b, err := os.ReadFile(c.headerPath(hash))
+	if err != nil {
+		return storedMeta{}, false
+	}
+	var meta storedMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return storedMeta{}, false
+	}
+	return meta, true
+}
+
+func (c *FS) Get(key string) (io.ReadCloser, http.Header, bool) {
+	hash := hashKey(key)
+	meta, ok := c.readMeta(hash)
+	if !ok {
+		return nil, nil, false
+	}
+	if !meta.ExpiresAt.IsZero() && time.Now().After(meta.ExpiresAt) {
+		c.Delete(key)
+		return nil, nil, false
+	}
+	f, err := os.Open(c.dataPath(hash))
+	if err != nil {
+		return nil, nil, false
+	}
+	c.mutex.Lock()
+	if el, ok := c.index[hash]; ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mutex.Unlock()
+	return f, meta.Header, true
+}
+
+func (c *FS) Put(key string, header http.Header, body io.Reader) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	hash := hashKey(key)
+
+	tmp, err := os.CreateTemp(c.Dir, hash+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	n, copyErr := io.Copy(tmp, body)
+	closeErr := tmp.Close()
+	if copyErr != nil {
+		os.Remove(tmpName)
+		return copyErr
+	}
+	if closeErr != nil {
+		os.Remove(tmpName)
+		return closeErr
+	}
+	if err := os.Rename(tmpName, c.dataPath(hash)); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	meta := storedMeta{Header: header.Clone(), Size: n, ExpiresAt: freshUntil(header, time.Now())}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.headerPath(hash), metaBytes, 0644); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.recordSizeLocked(hash, n)
+	c.evictLocked()
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *FS) Delete(key string) {
+	hash := hashKey(key)
+	os.Remove(c.dataPath(hash))
+	os.Remove(c.headerPath(hash))
+	c.mutex.Lock()
+	c.removeLocked(hash)
+	c.mutex.Unlock()
+}
+
+func (c *FS) recordSizeLocked(hash string, size int64) {
+	if el, ok := c.index[hash]; ok {
+		c.curSize -= el.Value.(*lruEntry).size
+		el.Value.(*lruEntry).size = size
+		c.lru.MoveToFront(el)
+	} else {
+		el := c.lru.PushFront(&lruEntry{hash: hash, size: size})
+		c.index[hash] = el
+	}
+	c.curSize += size
+}
+
+func (c *FS) removeLocked(hash string) {
+	if el, ok := c.index[hash]; ok {
+		c.curSize -= el.Value.(*lruEntry).size
+		c.lru.Remove(el)
+		delete(c.index, hash)
+	}
+}
+
+func (c *FS) evictLocked() {
+	if c.MaxBytes <= 0 {
+		return
+	}
+	for c.curSize > c.MaxBytes {
+		back := c.lru.Back()
+		if back == nil {
+			break
+		}
+		e := back.Value.(*lruEntry)
+		c.lru.Remove(back)
+		delete(c.index, e.hash)
+		c.curSize -= e.size
+		os.Remove(c.dataPath(e.hash))
+		os.Remove(c.headerPath(e.hash))
+	}
+}
+
+// freshUntil 根据 Cache-Control/Expires 算出这份缓存还能用到什么时候；都没有的话给一个
+// 保守的默认 TTL。
+func freshUntil(h http.Header, storedAt time.Time) time.Time {
+	if cc := h.Get("Cache-Control"); cc != "" {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "no-store" || directive == "no-cache" {
+				return storedAt
+			}
+			if secs, ok := strings.CutPrefix(directive, "max-age="); ok {
+				if n, err := strconv.Atoi(secs); err == nil {
+					return storedAt.Add(time.Duration(n) * time.Second)
+				}
+			}
+		}
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			return t
+		}
+	}
+	return storedAt.Add(5 * time.Minute)
+}
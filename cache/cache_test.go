@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFS_PutGetRoundtrip(t *testing.T) {
+	c := NewFS(t.TempDir(), 0)
+
+	header := http.Header{"Content-Type": {"text/plain"}}
+	if err := c.Put("k1", header, strings.NewReader("hello")); err != nil {
+		t.Fatal("Put:", err)
+	}
+
+	body, got, ok := c.Get("k1")
+	if !ok {
+		t.Fatal("Get: miss after Put")
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("Get body = %q, %v, want %q", b, err, "hello")
+	}
+	if got.Get("Content-Type") != "text/plain" {
+		t.Fatalf("Get header = %v, want Content-Type: text/plain", got)
+	}
+}
+
+func TestFS_GetMiss(t *testing.T) {
+	c := NewFS(t.TempDir(), 0)
+	if _, _, ok := c.Get("absent"); ok {
+		t.Fatal("Get: want miss for absent key")
+	}
+}
+
+func TestFS_ExpiresViaMaxAge(t *testing.T) {
+	c := NewFS(t.TempDir(), 0)
+	header := http.Header{"Cache-Control": {"max-age=0"}}
+	if err := c.Put("k1", header, strings.NewReader("stale")); err != nil {
+		t.Fatal("Put:", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := c.Get("k1"); ok {
+		t.Fatal("Get: want miss for expired entry")
+	}
+}
+
+func TestFS_DeleteRemovesEntry(t *testing.T) {
+	c := NewFS(t.TempDir(), 0)
+	if err := c.Put("k1", http.Header{}, strings.NewReader("x")); err != nil {
+		t.Fatal("Put:", err)
+	}
+	c.Delete("k1")
+	if _, _, ok := c.Get("k1"); ok {
+		t.Fatal("Get: want miss after Delete")
+	}
+}
+
+func TestFS_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewFS(t.TempDir(), 9) // 只够放一个 5 字节的条目
+
+	if err := c.Put("a", http.Header{}, strings.NewReader("aaaaa")); err != nil {
+		t.Fatal("Put a:", err)
+	}
+	if err := c.Put("b", http.Header{}, strings.NewReader("bbbbb")); err != nil {
+		t.Fatal("Put b:", err)
+	}
+	// 超过 MaxBytes，应该淘汰掉最久未使用的 a，保留 b。
+	if _, _, ok := c.Get("a"); ok {
+		t.Fatal("Get a: want evicted")
+	}
+	if body, _, ok := c.Get("b"); !ok {
+		t.Fatal("Get b: want hit")
+	} else {
+		body.Close()
+	}
+}
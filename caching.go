@@ -0,0 +1,119 @@
+package qcdn
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// cacheKeyOf 把 resource 转成 Cache 的 key；FS 默认实现会再对它做 sha256。
+func cacheKeyOf(uri resource) string {
+	return uri.scheme + "://" + uri.host + uri.path
+}
+
+// serveFromCache 尝试直接用缓存回答请求，命中时返回 true 且不会碰任何源站。只有
+// GET/HEAD 会查缓存，其它 method（比如未来加的 PURGE）交给调用方走正常流程。
+func (p *QcdnProxy) serveFromCache(w http.ResponseWriter, req *http.Request, uri resource) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	body, header, ok := p.cache.Get(cacheKeyOf(uri))
+	if !ok {
+		return false
+	}
+	defer body.Close()
+	serveCachedBody(w, req, header, body)
+	return true
+}
+
+// serveCachedBody 把缓存里的 header/body 写回客户端，body 支持 io.Seeker 时按客户端
+// 的 Range 请求截取返回 206，否则退回整包 200。
+func serveCachedBody(w http.ResponseWriter, req *http.Request, header http.Header, body io.ReadCloser) {
+	dst := w.Header()
+	copyHeader(dst, header)
+	if rs, ok := body.(io.ReadSeeker); ok {
+		if h := req.Header.Get("Range"); h != "" {
+			if br, ok := parseByteRange(h); ok {
+				if serveCachedRange(w, dst, rs, br, req.Method == http.MethodHead) {
+					return
+				}
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		io.Copy(w, body)
+	}
+}
+
+// serveCachedRange 把 rs 按 br 截出的区间写成 206 响应；rs 取不到总长度时返回 false，
+// 调用方退回整包响应。br 本身不可满足（起点落在资源末尾之后）时直接回 416，而不是
+// 退回整包——那样会在 Content-Length 还声明着完整大小的情况下只写出空 body。
+func serveCachedRange(w http.ResponseWriter, header http.Header, rs io.ReadSeeker, br byteRange, headOnly bool) bool {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false
+	}
+	end := br.end
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	if br.start < 0 || br.start > end {
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+	if _, err := rs.Seek(br.start, io.SeekStart); err != nil {
+		return false
+	}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", br.start, end, size))
+	header.Set("Content-Length", strconv.FormatInt(end-br.start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if !headOnly {
+		io.CopyN(w, rs, end-br.start+1)
+	}
+	return true
+}
+
+// cacheableResponse 判断一个源站响应是否值得写入缓存：只缓存 GET 请求的完整 200。
+func cacheableResponse(method string, resp *http.Response) bool {
+	return method == http.MethodGet && resp.StatusCode == http.StatusOK
+}
+
+// teeToCache 把 resp.Body 包一层 TeeReader，ReverseProxy 照常把返回值流式拷给客户端的
+// 同时，另起一个 goroutine 把同样的字节喂给 cache.Put（Put 内部写临时文件再原子
+// rename，保证不会有人读到半成品）。Close 时如果还没读到 EOF 就说明客户端提前断开，
+// 这时放弃缓存而不是留下残缺内容。
+func (p *QcdnProxy) teeToCache(key string, resp *http.Response) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pr.CloseWithError(p.cache.Put(key, resp.Header, pr))
+	}()
+	return &cachingBody{orig: resp.Body, tee: io.TeeReader(resp.Body, pw), pw: pw}
+}
+
+type cachingBody struct {
+	orig io.ReadCloser
+	tee  io.Reader
+	pw   *io.PipeWriter
+	eof  bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.tee.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	if b.eof {
+		b.pw.Close()
+	} else {
+		b.pw.CloseWithError(io.ErrUnexpectedEOF)
+	}
+	return b.orig.Close()
+}
@@ -0,0 +1,151 @@
+package qcdn
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// HealthPolicy 决定 QcdnProxy 在主域名和多个备份域名之间如何选择与打分。实现可以是
+// 被动的（根据过去请求的延迟/错误率打分，见 DefaultHealthPolicy），也可以是加权轮询、
+// 按地域亲和性调度等主动策略。
+type HealthPolicy interface {
+	// Pick 从 candidates 中选出本次请求要尝试的 origin。candidates 不会为空。
+	Pick(candidates []urlBase) urlBase
+	// Observe 记录一次对 base 的请求结果：耗时、HTTP 状态码（请求出错时为 0）、错误。
+	Observe(base urlBase, latency time.Duration, statusCode int, err error)
+}
+
+// originHealth 保存单个 origin 的被动健康统计：延迟和错误率都用 EWMA（指数加权移动
+// 平均）滚动更新，连续失败达到阈值后进入冷却期，冷却期内不参与选择。
+type originHealth struct {
+	mutex sync.Mutex
+
+	ewmaLatencyMs    float64
+	ewmaErrorRate    float64
+	consecutiveFails int
+	unhealthyUntil   time.Time
+}
+
+// DefaultHealthPolicy 是开箱即用的被动健康策略：用 EWMA 滚动统计每个 origin 的延迟和
+// 5xx/超时错误率，选择时在候选里随机抽两个做 P2C（power-of-two-choices），取分数更好
+// 的那个；连续失败达到 FailThreshold 次的 origin 会被标记为不健康，在 Cooldown 内不
+// 参与竞争。
+type DefaultHealthPolicy struct {
+	mutex   sync.Mutex
+	origins map[urlBase]*originHealth
+
+	// FailThreshold 是连续失败多少次后把一个 origin 标记为不健康。
+	FailThreshold int
+	// Cooldown 是标记不健康之后多久重新参与候选竞争。
+	Cooldown time.Duration
+	// LatencyDecay / ErrorDecay 是 EWMA 的新样本权重，取值 (0, 1)，越大越看重最近的请求。
+	LatencyDecay float64
+	ErrorDecay   float64
+}
+
+// NewDefaultHealthPolicy 返回一个带有合理默认参数的 DefaultHealthPolicy。
+func NewDefaultHealthPolicy() *DefaultHealthPolicy {
+	return &DefaultHealthPolicy{
+		origins:       make(map[urlBase]*originHealth),
+		FailThreshold: 3,
+		Cooldown:      10 * time.Second,
+		LatencyDecay:  0.3,
+		ErrorDecay:    0.3,
+	}
+}
+
+func (h *DefaultHealthPolicy) stateOf(base urlBase) *originHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	st, ok := h.origins[base]
+	if !ok {
+		st = &originHealth{}
+		h.origins[base] = st
+	}
+	return st
+}
+
+func (h *DefaultHealthPolicy) Observe(base urlBase, latency time.Duration, statusCode int, err error) {
+	st := h.stateOf(base)
+	failed := err != nil || statusCode/100 == 5
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	ms := float64(latency.Milliseconds())
+	if st.ewmaLatencyMs == 0 {
+		st.ewmaLatencyMs = ms
+	} else {
+		st.ewmaLatencyMs = h.LatencyDecay*ms + (1-h.LatencyDecay)*st.ewmaLatencyMs
+	}
+
+	sample := 0.0
+	if failed {
+		sample = 1.0
+	}
+	st.ewmaErrorRate = h.ErrorDecay*sample + (1-h.ErrorDecay)*st.ewmaErrorRate
+
+	if failed {
+		st.consecutiveFails++
+		if st.consecutiveFails >= h.FailThreshold {
+			st.unhealthyUntil = time.Now().Add(h.Cooldown)
+		}
+	} else {
+		st.consecutiveFails = 0
+		st.unhealthyUntil = time.Time{}
+	}
+}
+
+// score 越小越好：在 EWMA 延迟的基础上按错误率加权放大。healthy 为 false 表示该
+// origin 正处于失败冷却期，不应该被选中。
+func (h *DefaultHealthPolicy) score(base urlBase) (score float64, healthy bool) {
+	st := h.stateOf(base)
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if !st.unhealthyUntil.IsZero() && time.Now().Before(st.unhealthyUntil) {
+		return 0, false
+	}
+	return st.ewmaLatencyMs * (1 + 9*st.ewmaErrorRate), true
+}
+
+func (h *DefaultHealthPolicy) Pick(candidates []urlBase) urlBase {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	i, j := randomPair(len(candidates))
+	aScore, aHealthy := h.score(candidates[i])
+	bScore, bHealthy := h.score(candidates[j])
+
+	switch {
+	case aHealthy && bHealthy:
+		if aScore <= bScore {
+			return candidates[i]
+		}
+		return candidates[j]
+	case aHealthy:
+		return candidates[i]
+	case bHealthy:
+		return candidates[j]
+	default:
+		// 抽到的两个都在冷却期，退化为挑第一个健康的；全都不健康就只能矬子里拔将军，
+		// 返回第一个候选，让调用方真实发起请求去驱动它的健康状态更新。
+		for _, c := range candidates {
+			if _, ok := h.score(c); ok {
+				return c
+			}
+		}
+		return candidates[0]
+	}
+}
+
+// randomPair 从 [0,n) 里随机挑两个不同的下标，用于 P2C 抽样。
+func randomPair(n int) (int, int) {
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	return i, j
+}
@@ -0,0 +1,202 @@
+package qcdn
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// breakerState 是单个 origin 熔断器的三态机，镜像 Hystrix 的 closed/open/half-open：
+// closed 正常放行、open 短路跳过、half-open 放行一次探测判断是否恢复。
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// originBreaker 是单个 origin 的熔断状态，由后台探测 goroutine 驱动：连续探测失败
+// 达到 BreakerFailThreshold 次后跳闸进入 open，BreakerOpenTimeout 过后下一轮探测转入
+// half-open 放行一次探测，探测成功回到 closed，失败则重新 open 并续期冷却。
+type originBreaker struct {
+	mutex sync.Mutex
+
+	state            breakerState
+	consecutiveFails int
+	openedAt         time.Time
+
+	lastLatency   time.Duration
+	ewmaErrorRate float64
+}
+
+// OriginStat 是 OriginStats 返回的单个 origin 快照。
+type OriginStat struct {
+	State       string
+	LastLatency time.Duration
+	ErrorRate   float64
+}
+
+// OriginStats 返回当前所有被主动探测过的 origin 的熔断状态快照，key 是 "scheme://host"，
+// 供测试和可观测性场景使用；没有开启 HealthCheckInterval 时返回空 map。
+func (p *QcdnProxy) OriginStats() map[string]OriginStat {
+	p.breakersMu.Lock()
+	defer p.breakersMu.Unlock()
+	out := make(map[string]OriginStat, len(p.breakers))
+	for base, b := range p.breakers {
+		b.mutex.Lock()
+		out[base.scheme+"://"+base.host] = OriginStat{
+			State:       b.state.String(),
+			LastLatency: b.lastLatency,
+			ErrorRate:   b.ewmaErrorRate,
+		}
+		b.mutex.Unlock()
+	}
+	return out
+}
+
+// breakerFor 返回 base 对应的 originBreaker，不存在时创建一个初始 closed 状态的。
+func (p *QcdnProxy) breakerFor(base urlBase) *originBreaker {
+	p.breakersMu.Lock()
+	defer p.breakersMu.Unlock()
+	b, ok := p.breakers[base]
+	if !ok {
+		b = &originBreaker{}
+		p.breakers[base] = b
+	}
+	return b
+}
+
+// breakerOpen 判断 base 当前是否处于 open（短路中），不认识的 base 视为 closed。
+func (p *QcdnProxy) breakerOpen(base urlBase) bool {
+	p.breakersMu.Lock()
+	b, ok := p.breakers[base]
+	p.breakersMu.Unlock()
+	if !ok {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == breakerOpen
+}
+
+// startHealthChecker 启动后台探测 goroutine，对 strategies 里出现过的每个 urlBase
+// 按 conf.HealthCheckInterval 周期发起一次 HEAD 探测，驱动对应 originBreaker 的状态
+// 迁移。随 Close 取消。
+func (p *QcdnProxy) startHealthChecker(conf *QcdnConfig) {
+	path := conf.HealthCheckPath
+	if path == "" {
+		path = "/"
+	}
+	failThreshold := conf.BreakerFailThreshold
+	if failThreshold <= 0 {
+		failThreshold = 3
+	}
+	openTimeout := conf.BreakerOpenTimeout
+	if openTimeout <= 0 {
+		openTimeout = 10 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.probeStop = cancel
+	p.probeDone = make(chan struct{})
+
+	go func() {
+		defer close(p.probeDone)
+		ticker := time.NewTicker(conf.HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.probeOrigins(ctx, path, failThreshold, openTimeout)
+			}
+		}
+	}()
+}
+
+// probeOrigins 对当前 strategies 里出现过的每个 urlBase（主域名、所有 backup、Boot
+// 域名）各探测一次。
+func (p *QcdnProxy) probeOrigins(ctx context.Context, path string, failThreshold int, openTimeout time.Duration) {
+	for base := range p.originsToProbe() {
+		p.probeOne(ctx, base, path, failThreshold, openTimeout)
+	}
+}
+
+func (p *QcdnProxy) originsToProbe() map[urlBase]bool {
+	p.strategiesMu.RLock()
+	defer p.strategiesMu.RUnlock()
+	set := make(map[urlBase]bool)
+	for base, s := range p.strategies {
+		set[base] = true
+		for _, backup := range s.backups {
+			set[backup] = true
+		}
+		if s.boot != (urlBase{}) {
+			set[s.boot] = true
+		}
+	}
+	return set
+}
+
+// probeOne 对 base 发起一次探测，更新它的 originBreaker：open 状态下只有冷却期满才
+// 会转入 half-open 并放行这一次探测，其余情况下照常探测。
+func (p *QcdnProxy) probeOne(ctx context.Context, base urlBase, path string, failThreshold int, openTimeout time.Duration) {
+	br := p.breakerFor(base)
+
+	br.mutex.Lock()
+	if br.state == breakerOpen {
+		if time.Since(br.openedAt) < openTimeout {
+			br.mutex.Unlock()
+			return
+		}
+		br.state = breakerHalfOpen
+	}
+	br.mutex.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, base.scheme+"://"+base.host+path, nil)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	resp, doErr := p.client.Do(req)
+	latency := time.Since(start)
+	healthy := doErr == nil && resp.StatusCode < http.StatusInternalServerError
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	br.lastLatency = latency
+	sample := 0.0
+	if !healthy {
+		sample = 1.0
+	}
+	br.ewmaErrorRate = 0.3*sample + 0.7*br.ewmaErrorRate
+
+	if healthy {
+		br.consecutiveFails = 0
+		br.state = breakerClosed
+		br.openedAt = time.Time{}
+		return
+	}
+	br.consecutiveFails++
+	if br.state == breakerHalfOpen || br.consecutiveFails >= failThreshold {
+		br.state = breakerOpen
+		br.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,127 @@
+package qcdn
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Logger 是可插拔的结构化日志接口，msg 是事件名，args 和 fmt.Sprintf 一样按 verb
+// 展开，约定把 key=value 对写进 msg 里（origin、status、latency、
+// decision=primary|backup|cached|redirected 等），方便日志系统按字段切分。
+type Logger interface {
+	Debugf(msg string, args ...interface{})
+	Infof(msg string, args ...interface{})
+	Warnf(msg string, args ...interface{})
+}
+
+// stdLogger 是默认的 Logger 实现，直接写到标准库 log 包，每条加上 [debug]/[info]/[warn]
+// 前缀，不按级别过滤。
+type stdLogger struct{}
+
+func (stdLogger) Debugf(msg string, args ...interface{}) { log.Printf("[debug] "+msg, args...) }
+func (stdLogger) Infof(msg string, args ...interface{})  { log.Printf("[info] "+msg, args...) }
+func (stdLogger) Warnf(msg string, args ...interface{})  { log.Printf("[warn] "+msg, args...) }
+
+// Metrics 是可插拔的指标接口，命名和语义参照 Prometheus 的习惯：*Total 是计数器，
+// UpstreamLatencySeconds 是按 origin 分桶的延迟观测，RedirectCacheSize 是当前
+// redirect 缓存的条目数（一个 gauge）。
+type Metrics interface {
+	// IncRequestsTotal 记录一次对 origin 的请求，status 是 HTTP 状态码的字符串形式，
+	// 或者 "error" 表示请求没有正常收到响应。
+	IncRequestsTotal(origin, status string)
+	// ObserveUpstreamLatency 记录一次对 origin 的请求耗时。
+	ObserveUpstreamLatency(origin string, d time.Duration)
+	// IncFailoverTotal 记录一次从 from 切换到 to 的 failover。
+	IncFailoverTotal(from, to string)
+	// SetRedirectCacheSize 更新 redirect 缓存当前的条目数。
+	SetRedirectCacheSize(n int)
+}
+
+// NopMetrics 是默认的 Metrics 实现，什么都不做，供没有接指标系统时使用。
+type NopMetrics struct{}
+
+func (NopMetrics) IncRequestsTotal(origin, status string)                {}
+func (NopMetrics) ObserveUpstreamLatency(origin string, d time.Duration) {}
+func (NopMetrics) IncFailoverTotal(from, to string)                      {}
+func (NopMetrics) SetRedirectCacheSize(n int)                            {}
+
+// latencyStat 用 sum/count 实现一个极简的 expvar.Var，没有分桶，只有总量和平均值。
+type latencyStat struct {
+	mutex sync.Mutex
+	sum   float64
+	count int64
+}
+
+func (s *latencyStat) observe(d time.Duration) {
+	s.mutex.Lock()
+	s.sum += d.Seconds()
+	s.count++
+	s.mutex.Unlock()
+}
+
+func (s *latencyStat) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	avg := 0.0
+	if s.count > 0 {
+		avg = s.sum / float64(s.count)
+	}
+	return fmt.Sprintf(`{"sum":%g,"count":%d,"avg":%g}`, s.sum, s.count, avg)
+}
+
+// ExpvarMetrics 是基于标准库 expvar 的 Metrics 实现，把四个指标都挂在
+// expvar.NewMap(name) 下面，可以直接从 /debug/vars 里看到。name 在进程内必须唯一，
+// 和 expvar 本身的要求一样。
+type ExpvarMetrics struct {
+	requestsTotal     *expvar.Map
+	failoverTotal     *expvar.Map
+	redirectCacheSize *expvar.Int
+
+	latencyMu  sync.Mutex
+	latency    map[string]*latencyStat
+	latencyMap *expvar.Map
+}
+
+// NewExpvarMetrics 注册并返回一个挂在 expvar.NewMap(name) 下面的 ExpvarMetrics。
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{
+		requestsTotal:     new(expvar.Map).Init(),
+		failoverTotal:     new(expvar.Map).Init(),
+		redirectCacheSize: new(expvar.Int),
+		latency:           make(map[string]*latencyStat),
+		latencyMap:        new(expvar.Map).Init(),
+	}
+	root := expvar.NewMap(name)
+	root.Set("RequestsTotal", m.requestsTotal)
+	root.Set("UpstreamLatencySeconds", m.latencyMap)
+	root.Set("FailoverTotal", m.failoverTotal)
+	root.Set("RedirectCacheSize", m.redirectCacheSize)
+	return m
+}
+
+func (m *ExpvarMetrics) IncRequestsTotal(origin, status string) {
+	m.requestsTotal.Add(origin+","+status, 1)
+}
+
+func (m *ExpvarMetrics) ObserveUpstreamLatency(origin string, d time.Duration) {
+	m.latencyMu.Lock()
+	st, ok := m.latency[origin]
+	if !ok {
+		st = &latencyStat{}
+		m.latency[origin] = st
+		m.latencyMap.Set(origin, st)
+	}
+	m.latencyMu.Unlock()
+	st.observe(d)
+}
+
+func (m *ExpvarMetrics) IncFailoverTotal(from, to string) {
+	m.failoverTotal.Add(from+"->"+to, 1)
+}
+
+func (m *ExpvarMetrics) SetRedirectCacheSize(n int) {
+	m.redirectCacheSize.Set(int64(n))
+}
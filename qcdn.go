@@ -1,15 +1,18 @@
 package qcdn
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/xushiwei/qcdn/cache"
 )
 
 /* -------------------------------------------------------------------------------
@@ -18,7 +21,7 @@ import (
 
 proxy := NewQcdnProxy()
 proxy.SetStrategy("https://example-qcdn.com", &QcdnStrategy{
-	Backup: "https://example-cdn.com", // 备份域名，主域名下载失败的时候启用
+	Backups: []string{"https://example-cdn.com"}, // 备份域名列表，主域名下载失败的时候按健康度择优启用
 	Boot: "https://example-cdn.com", // 首开优化域名，在 MakeVodURL 传入非 0 的 bootLen 时启用
 })
 
@@ -33,33 +36,89 @@ type QcdnProxy struct {
 	server    *httptest.Server
 	init      sync.Once
 
-	strategies map[urlBase]*urlStrategy // urlBase => strategy
+	strategiesMu sync.RWMutex
+	strategies   map[urlBase]*urlStrategy // urlBase => strategy
+
+	mutex       sync.Mutex
+	redirects   map[resource]resource
+	bootDecided map[resource]bool // resource => Boot 域名是否支持首开分段加速
+
+	health HealthPolicy // 主域名/备份域名的健康评估与选择策略
+	cache  cache.Cache  // 可选的本地资源缓存，nil 表示不开启
+
+	breakersMu sync.Mutex
+	breakers   map[urlBase]*originBreaker // urlBase => 主动探测得到的熔断状态
+	probeStop  context.CancelFunc         // 停止后台探测 goroutine，nil 表示没开启
+	probeDone  chan struct{}
 
-	mutex     sync.Mutex
-	redirects map[resource]resource
+	logger  Logger  // 结构化日志，默认写到标准库 log
+	metrics Metrics // 计数器/直方图，默认是个 no-op
 
 	client http.Client
 }
 
 type QcdnConfig struct {
 	Timeout int // in ms
+
+	// Cache 是可选的本地资源缓存；配置后 handle 命中缓存时不再请求任何源站，未命中时
+	// 把源站响应写入缓存供下次使用。nil 表示不开启缓存，行为和之前完全一致。
+	Cache cache.Cache
+
+	// HealthCheckInterval 是后台探测 goroutine 对 strategies 里出现过的每个 urlBase
+	// （主域名和所有 backup）发起一次探测请求的周期；<= 0 表示不开启主动健康检查，
+	// 熔断器永远保持 closed，行为和之前完全一致。
+	HealthCheckInterval time.Duration
+	// HealthCheckPath 是探测请求的路径，默认为 "/"。
+	HealthCheckPath string
+	// BreakerFailThreshold 是连续探测失败多少次后跳闸进入 open，默认 3。
+	BreakerFailThreshold int
+	// BreakerOpenTimeout 是跳闸之后多久转入 half-open 尝试恢复，默认 10s。
+	BreakerOpenTimeout time.Duration
+
+	// Logger 是可选的结构化日志实现，nil 时默认用标准库 log 包打印，Debugf/Infof/Warnf
+	// 各级别都会输出，不做过滤。
+	Logger Logger
+	// Metrics 是可选的计数器/直方图实现，nil 时默认是个 no-op。
+	Metrics Metrics
 }
 
 func NewQcdnProxy(conf *QcdnConfig) *QcdnProxy {
 	if conf == nil {
 		conf = new(QcdnConfig)
 	}
-	return &QcdnProxy{
-		redirects:  make(map[resource]resource),
-		strategies: make(map[urlBase]*urlStrategy),
+	logger := conf.Logger
+	if logger == nil {
+		logger = stdLogger{}
+	}
+	metrics := conf.Metrics
+	if metrics == nil {
+		metrics = NopMetrics{}
+	}
+	p := &QcdnProxy{
+		redirects:   make(map[resource]resource),
+		bootDecided: make(map[resource]bool),
+		strategies:  make(map[urlBase]*urlStrategy),
+		health:      NewDefaultHealthPolicy(),
+		cache:       conf.Cache,
+		breakers:    make(map[urlBase]*originBreaker),
+		logger:      logger,
+		metrics:     metrics,
 		client: http.Client{
 			Transport: http.DefaultTransport,
 			Timeout:   time.Duration(conf.Timeout) * time.Millisecond,
 		},
 	}
+	if conf.HealthCheckInterval > 0 {
+		p.startHealthChecker(conf)
+	}
+	return p
 }
 
 func (p *QcdnProxy) Close() {
+	if p.probeStop != nil {
+		p.probeStop()
+		<-p.probeDone
+	}
 	if s := p.server; s != nil {
 		p.server = nil
 		s.Close()
@@ -67,16 +126,37 @@ func (p *QcdnProxy) Close() {
 }
 
 type QcdnStrategy struct {
-	Backup string
-	Boot   string
+	Backups []string
+	Boot    string
 }
 
 func (p *QcdnProxy) SetStrategy(urlBase_ string, s *QcdnStrategy) {
-	urlBase := urlBaseOf(urlBase_)
-	p.strategies[urlBase] = &urlStrategy{
-		backup: urlBaseOf(s.Backup),
-		boot:   urlBaseOf(s.Boot),
+	base := urlBaseOf(urlBase_)
+	backups := make([]urlBase, len(s.Backups))
+	for i, backup := range s.Backups {
+		backups[i] = urlBaseOf(backup)
 	}
+	p.strategiesMu.Lock()
+	p.strategies[base] = &urlStrategy{
+		backups: backups,
+		boot:    urlBaseOf(s.Boot),
+	}
+	p.strategiesMu.Unlock()
+}
+
+// strategyOf 是 p.strategies 的并发安全读取，后台探测 goroutine 和请求处理 goroutine
+// 都要通过它访问，不能直接操作 map。
+func (p *QcdnProxy) strategyOf(base urlBase) (*urlStrategy, bool) {
+	p.strategiesMu.RLock()
+	s, ok := p.strategies[base]
+	p.strategiesMu.RUnlock()
+	return s, ok
+}
+
+// SetHealthPolicy 替换默认的健康评估与选择策略，比如换成加权轮询或者按地域亲和性
+// 调度的实现。不调用时使用 NewDefaultHealthPolicy 返回的被动 EWMA 打分策略。
+func (p *QcdnProxy) SetHealthPolicy(h HealthPolicy) {
+	p.health = h
 }
 
 func (p *QcdnProxy) MakeVodURL(urlVod string, bootLen int) string {
@@ -84,16 +164,45 @@ func (p *QcdnProxy) MakeVodURL(urlVod string, bootLen int) string {
 	if err != nil {
 		return urlVod
 	}
-	_, ok := p.strategies[urlBase{url.Scheme, url.Host}]
+	_, ok := p.strategyOf(urlBase{url.Scheme, url.Host})
 	if !ok {
 		return urlVod // 这个 url 没有策略，认为不由我们 Proxy 管辖，返回原始 url
 	}
 	url.Path = makeProxyPath(url.Scheme, url.Host, url.Path)
+	if bootLen > 0 {
+		q := url.Query()
+		q.Set(bootLenParam, strconv.Itoa(bootLen))
+		url.RawQuery = q.Encode()
+	}
 	url.Scheme = "http"
 	url.Host = p.getProxyHost()
 	return url.String()
 }
 
+// bootLenParam 是传递 bootLen 给 handle 的内部 query 参数，请求到达 handle 后会被剥离，
+// 不会转发给源站。
+const bootLenParam = "_qcdnBootLen"
+
+// popBootLen 从 proxy 请求的 query 里取出并移除 bootLenParam，返回调用 MakeVodURL 时
+// 传入的 bootLen；不存在或非法时返回 0。
+func popBootLen(u *url.URL) int {
+	if u.RawQuery == "" {
+		return 0
+	}
+	q := u.Query()
+	v := q.Get(bootLenParam)
+	if v == "" {
+		return 0
+	}
+	q.Del(bootLenParam)
+	u.RawQuery = q.Encode()
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
 type resource struct {
 	urlBase
 	path string
@@ -107,9 +216,24 @@ func (p *QcdnProxy) redirectOf(uri resource) (ret resource, ok bool) {
 }
 
 func (p *QcdnProxy) setRedirect(uri, to resource) {
-	log.Println("setRedirect:", uri, to)
 	p.mutex.Lock()
 	p.redirects[uri] = to
+	n := len(p.redirects)
+	p.mutex.Unlock()
+	p.logger.Infof("setRedirect: origin=%s path=%s decision=redirected to_origin=%s to_path=%s", uri.host, uri.path, to.host, to.path)
+	p.metrics.SetRedirectCacheSize(n)
+}
+
+func (p *QcdnProxy) bootDecisionOf(uri resource) (supported, done bool) {
+	p.mutex.Lock()
+	supported, done = p.bootDecided[uri]
+	p.mutex.Unlock()
+	return
+}
+
+func (p *QcdnProxy) setBootDecision(uri resource, supported bool) {
+	p.mutex.Lock()
+	p.bootDecided[uri] = supported
 	p.mutex.Unlock()
 }
 
@@ -126,8 +250,8 @@ func urlBaseOf(urlBase_ string) urlBase {
 }
 
 type urlStrategy struct {
-	backup urlBase
-	boot   urlBase
+	backups []urlBase
+	boot    urlBase
 }
 
 func (p *QcdnProxy) getProxyHost() string {
@@ -140,59 +264,227 @@ func (p *QcdnProxy) getProxyHost() string {
 }
 
 func (p *QcdnProxy) handle(w http.ResponseWriter, req *http.Request) {
-	url := req.URL
-	uri, ok := parseProxyPath(url.Path)
+	uri, ok := parseProxyPath(req.URL.Path)
 	if !ok {
 		http.Error(w, "invalid proxy path", 500)
 		return
 	}
+	if bootLen := popBootLen(req.URL); bootLen > 0 && p.tryBootSplit(w, req, uri, bootLen) {
+		return
+	}
+
+	s, ok := p.strategyOf(uri.urlBase)
+	if !ok {
+		http.Error(w, "url strategy not found", 500)
+		return
+	}
+
+	if p.cache != nil && p.serveFromCache(w, req, uri) {
+		p.logger.Debugf("handle: decision=cached origin=%s path=%s", uri.host, uri.path)
+		return
+	}
+
+	if timeout := p.client.Timeout; timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	target := uri
+	cacheOnSuccess := true
 	if uriRedirect, ok := p.redirectOf(uri); ok { // 如果已经进行过 redirect，直接用缓存的 redirectUrl
-		url.Path = uriRedirect.path
-		url.Scheme = uriRedirect.scheme
-		url.Host = uriRedirect.host
-		req.Host = url.Host
-		req.RequestURI = ""
-		if serveRequest(p.client, w, req) {
+		target = uriRedirect
+		cacheOnSuccess = false
+	}
+	backups := make([]urlBase, 0, len(s.backups))
+	for _, backup := range s.backups {
+		if backup != target.urlBase {
+			backups = append(backups, backup)
+		}
+	}
+
+	if p.breakerOpen(target.urlBase) {
+		if next, rest, ok := p.popCandidate(backups); ok {
+			// 主域名的熔断器处于 open，直接跳过它去试 backup，省掉一次注定失败的往返。
+			p.logger.Infof("handle: decision=backup reason=breaker-open origin=%s path=%s backup=%s", target.host, uri.path, next.host)
+			p.metrics.IncFailoverTotal(target.host, next.host)
+			p.attemptOrigin(w, req, uri, resource{next, uri.path}, rest, true, maxProxyHops)
 			return
 		}
-	} else {
-		url.Path = uri.path
-		url.Scheme = uri.scheme
-		url.Host = uri.host
-		req.Host = url.Host
-		req.RequestURI = ""
-		var last *http.Request
-		client := p.client
-		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-			if len(via) >= 10 {
-				return errors.New("stopped after 10 redirects")
+	}
+	decision := "primary"
+	if !cacheOnSuccess {
+		decision = "redirected"
+	}
+	p.logger.Debugf("handle: decision=%s origin=%s path=%s", decision, target.host, uri.path)
+	p.attemptOrigin(w, req, uri, target, backups, cacheOnSuccess, maxProxyHops)
+}
+
+// byteRange 是解析后的客户端 Range 请求，end == -1 表示开区间（到资源末尾）。
+type byteRange struct {
+	start, end int64
+}
+
+func parseByteRange(h string) (byteRange, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(h, prefix) {
+		return byteRange{}, false
+	}
+	parts := strings.SplitN(h[len(prefix):], "-", 2)
+	if len(parts) != 2 {
+		return byteRange{}, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return byteRange{}, false
+	}
+	if parts[1] == "" {
+		return byteRange{start, -1}, true
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return byteRange{}, false
+	}
+	return byteRange{start, end}, true
+}
+
+// tryBootSplit 尝试把请求拆成 [0,bootLen) 和 [bootLen,end) 两段，分别从 Boot 域名和
+// 主域名并发拉取，再按顺序把它们写回客户端，从而加速首帧展现。拆分失败（策略没有配置
+// Boot 域名、Boot 之前探测不支持、Range 不认识、子请求失败等）时返回 false，调用方应
+// 继续走普通的单源流程。
+func (p *QcdnProxy) tryBootSplit(w http.ResponseWriter, req *http.Request, uri resource, bootLen int) bool {
+	s, ok := p.strategyOf(uri.urlBase)
+	if !ok || s.boot == (urlBase{}) {
+		return false
+	}
+	if supported, done := p.bootDecisionOf(uri); done && !supported {
+		return false // 之前已经探测过，Boot 域名不可用，不再反复尝试
+	}
+
+	want := byteRange{0, -1}
+	hasClientRange := false
+	if h := req.Header.Get("Range"); h != "" {
+		br, ok := parseByteRange(h)
+		if !ok {
+			return false // Range 语法不认识，交给普通流程处理
+		}
+		want, hasClientRange = br, true
+	}
+
+	bootEnd := int64(bootLen) - 1
+	if want.start > bootEnd {
+		return false // 请求起点落在主域名区间，走普通流程即可
+	}
+
+	bootRangeEnd := bootEnd
+	if want.end >= 0 && want.end < bootRangeEnd {
+		bootRangeEnd = want.end
+	}
+	bootReq := cloneRequestTo(req, s.boot, uri.path)
+	bootReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", want.start, bootRangeEnd))
+
+	mainStart := bootEnd + 1
+	needMain := want.end < 0 || want.end >= mainStart
+	var mainReq *http.Request
+	if needMain {
+		mainReq = cloneRequestTo(req, uri.urlBase, uri.path)
+		if want.end >= 0 {
+			mainReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", mainStart, want.end))
+		} else {
+			mainReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", mainStart))
+		}
+	}
+
+	type fetchResult struct {
+		resp *http.Response
+		err  error
+	}
+	bootCh := make(chan fetchResult, 1)
+	go func() {
+		resp, err := p.client.Do(bootReq)
+		bootCh <- fetchResult{resp, err}
+	}()
+	var mainCh chan fetchResult
+	if needMain {
+		mainCh = make(chan fetchResult, 1)
+		go func() {
+			resp, err := p.client.Do(mainReq)
+			mainCh <- fetchResult{resp, err}
+		}()
+	}
+
+	boot := <-bootCh
+	if boot.err != nil || boot.resp.StatusCode != http.StatusPartialContent {
+		if boot.resp != nil {
+			boot.resp.Body.Close()
+		}
+		if needMain {
+			if main := <-mainCh; main.resp != nil {
+				main.resp.Body.Close()
 			}
-			last = req
-			return nil
 		}
-		if serveRequest(client, w, req) && last != nil { // 请求成功并且存在 redirect，缓存它
-			lastURL := last.URL
-			urlBase := urlBase{lastURL.Scheme, lastURL.Host}
-			p.setRedirect(uri, resource{urlBase, lastURL.Path})
-			return
+		p.setBootDecision(uri, false) // Boot 域名不支持 Range，记住决策，后续请求不再探测
+		return false
+	}
+	defer boot.resp.Body.Close()
+
+	var main fetchResult
+	if needMain {
+		main = <-mainCh
+		if main.err != nil || main.resp.StatusCode/100 != 2 {
+			if main.resp != nil {
+				main.resp.Body.Close()
+			}
+			return false
 		}
+		defer main.resp.Body.Close()
 	}
-	s, ok := p.strategies[uri.urlBase]
-	if !ok {
-		http.Error(w, "url strategy not found", 500)
-		return
+
+	p.setBootDecision(uri, true)
+
+	header := w.Header()
+	copyHeader(header, boot.resp.Header)
+	header.Del("Content-Length") // 总长度要两段都读出来才知道，交给 chunked 传输
+	status := http.StatusOK
+	if hasClientRange {
+		status = http.StatusPartialContent
+		if needMain {
+			if cr := main.resp.Header.Get("Content-Range"); cr != "" {
+				header.Set("Content-Range", rebuildContentRange(want, cr))
+			}
+		}
+	} else {
+		header.Del("Content-Range")
 	}
-	if url.Host != s.backup.host {
-		url.Path = uri.path
-		url.Scheme = s.backup.scheme
-		url.Host = s.backup.host
-		req.Host = url.Host
-		if serveRequest(p.client, w, req) { // 后续这个资源都请求到 backup 域名
-			p.setRedirect(uri, resource{s.backup, uri.path})
-			return
+	w.WriteHeader(status)
+
+	io.Copy(w, boot.resp.Body)
+	if needMain {
+		io.Copy(w, main.resp.Body)
+	}
+	return true
+}
+
+// cloneRequestTo 复制 req，把目标改为 base+path，用于向 Boot/主域名发起子请求。
+func cloneRequestTo(req *http.Request, base urlBase, path string) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.URL = &url.URL{Scheme: base.scheme, Host: base.host, Path: path}
+	clone.Host = base.host
+	clone.RequestURI = ""
+	return clone
+}
+
+// rebuildContentRange 用主域名分段响应里的 Content-Range（带资源总大小）重新计算出
+// 对客户端请求的绝对 Range 区间对应的 Content-Range。
+func rebuildContentRange(want byteRange, mainContentRange string) string {
+	total := mainContentRange[strings.LastIndex(mainContentRange, "/")+1:]
+	end := want.end
+	if end < 0 {
+		if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+			end = n - 1
 		}
 	}
-	http.Error(w, "both main and backup server fail", 500)
+	return fmt.Sprintf("bytes %d-%d/%s", want.start, end, total)
 }
 
 func makeProxyPath(scheme, host, path string) string {
@@ -212,20 +504,6 @@ func parseProxyPath(proxyPath string) (uri resource, ok bool) {
 	return resource{urlBase, "/" + parts[1]}, true
 }
 
-func serveRequest(client http.Client, w http.ResponseWriter, req *http.Request) bool {
-	resp, err := client.Do(req)
-	if err == nil {
-		defer resp.Body.Close()
-		if resp.StatusCode/100 != 5 { // 5xx
-			copyHeader(w.Header(), resp.Header)
-			w.WriteHeader(resp.StatusCode)
-			io.Copy(w, resp.Body)
-			return true
-		}
-	}
-	return false
-}
-
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -1,11 +1,19 @@
 package qcdn
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/xushiwei/qcdn/cache"
 )
 
 func TestQcdn_MainOK(t *testing.T) {
@@ -19,7 +27,7 @@ func TestQcdn_MainOK(t *testing.T) {
 	defer proxy.Close()
 
 	proxy.SetStrategy(echo.URL, &QcdnStrategy{
-		Backup: "http://not-exist.com",
+		Backups: []string{"http://not-exist.com"},
 	})
 
 	url := proxy.MakeVodURL(echo.URL+"/hello", 0)
@@ -52,7 +60,7 @@ func TestQcdn_Main302(t *testing.T) {
 	defer proxy.Close()
 
 	proxy.SetStrategy(s302.URL, &QcdnStrategy{
-		Backup: "http://not-exist.com",
+		Backups: []string{"http://not-exist.com"},
 	})
 
 	url := proxy.MakeVodURL(s302.URL+"/hello", 0)
@@ -83,7 +91,7 @@ func TestQcdn_MainFail(t *testing.T) {
 	defer proxy.Close()
 
 	proxy.SetStrategy(fail.URL, &QcdnStrategy{
-		Backup: backup.URL,
+		Backups: []string{backup.URL},
 	})
 
 	url := proxy.MakeVodURL(fail.URL+"/hello", 0)
@@ -93,6 +101,474 @@ func TestQcdn_MainFail(t *testing.T) {
 	checkHttpResp(t, resp, err, 200, "backup")
 }
 
+func TestQcdn_HeadAndRangePassthrough(t *testing.T) {
+	content := []byte("0123456789ABCDEFGHIJ") // 20 bytes
+	origin := httptest.NewServer(rangeEchoHandler(content))
+	defer origin.Close()
+	log.Println("origin.URL:", origin.URL)
+
+	proxy := NewQcdnProxy(nil)
+	defer proxy.Close()
+
+	proxy.SetStrategy(origin.URL, &QcdnStrategy{
+		Backups: []string{"http://not-exist.com"},
+	})
+
+	proxyURL := proxy.MakeVodURL(origin.URL+"/video.mp4", 0)
+	log.Println("proxy.MakeVodURL:", proxyURL)
+
+	req, err := http.NewRequest(http.MethodHead, proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("HEAD status = %d, want 200", resp.StatusCode)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=5-9")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Range GET status = %d, want 206", resp.StatusCode)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := string(content[5:10]); string(got) != want {
+		t.Fatalf("Range GET body = %q, want %q", got, want)
+	}
+}
+
+func TestQcdn_FailoverAvoidsUnhealthyBackup(t *testing.T) {
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+		io.WriteString(w, "fail")
+	}))
+	defer fail.Close()
+	log.Println("fail.URL:", fail.URL)
+
+	var goodA, goodB int32
+	backupA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&goodA, 1)
+		io.WriteString(w, "backupA")
+	}))
+	defer backupA.Close()
+	log.Println("backupA.URL:", backupA.URL)
+
+	var unhealthyHits int32
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&unhealthyHits, 1)
+		w.WriteHeader(500)
+		io.WriteString(w, "unhealthy")
+	}))
+	defer unhealthy.Close()
+	log.Println("unhealthy.URL:", unhealthy.URL)
+
+	backupB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&goodB, 1)
+		io.WriteString(w, "backupB")
+	}))
+	defer backupB.Close()
+	log.Println("backupB.URL:", backupB.URL)
+
+	proxy := NewQcdnProxy(nil)
+	defer proxy.Close()
+
+	proxy.SetStrategy(fail.URL, &QcdnStrategy{
+		Backups: []string{backupA.URL, unhealthy.URL, backupB.URL},
+	})
+
+	// 每次请求一个不同的资源：backup 成功后会被 setRedirect 缓存为该资源的目标，同一个
+	// 资源的后续请求会直接走缓存，不再经过 failover。换资源才能让每次请求都先在主域名
+	// 失败、再走一遍 failover 循环；unhealthy 被记录为失败之后，failover 不应该再落到它头上。
+	for i := 0; i < 20; i++ {
+		url := proxy.MakeVodURL(fmt.Sprintf("%s/hello%d", fail.URL, i), 0)
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal("proxy.MakeVodURL resp:", err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal("io.ReadAll:", err)
+		}
+		if string(b) != "backupA" && string(b) != "backupB" {
+			t.Fatalf("request %d served by unexpected backend: %q", i, b)
+		}
+	}
+	if goodA+goodB != 20 {
+		t.Fatalf("expected all 20 requests served by healthy backups, got A=%d B=%d", goodA, goodB)
+	}
+	// unhealthy 必须真的被打过流量（否则这个测试没验证任何 failover 行为），但一旦
+	// 连续失败次数达到 DefaultHealthPolicy 的 FailThreshold（3），它就应该进入冷却期，
+	// 不再被 EWMA/P2C 选中——这是这个请求要的评分/熔断能力，不是单纯的轮询失败跳过。
+	hits := atomic.LoadInt32(&unhealthyHits)
+	if hits == 0 {
+		t.Fatal("unhealthy backend was never tried; test doesn't exercise failover at all")
+	}
+	if hits > 3 {
+		t.Fatalf("unhealthy backend hit %d times, want scoring to stop picking it after FailThreshold (3)", hits)
+	}
+}
+
+func TestQcdn_BootSplit(t *testing.T) {
+	content := []byte("0123456789ABCDEFGHIJ") // 20 bytes
+	bootLen := 8
+
+	main := httptest.NewServer(rangeEchoHandler(content))
+	defer main.Close()
+	log.Println("main.URL:", main.URL)
+
+	boot := httptest.NewServer(rangeEchoHandler(content))
+	defer boot.Close()
+	log.Println("boot.URL:", boot.URL)
+
+	proxy := NewQcdnProxy(nil)
+	defer proxy.Close()
+
+	proxy.SetStrategy(main.URL, &QcdnStrategy{
+		Backups: []string{"http://not-exist.com"},
+		Boot:    boot.URL,
+	})
+
+	url := proxy.MakeVodURL(main.URL+"/video.mp4", bootLen)
+	log.Println("proxy.MakeVodURL:", url)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal("proxy.MakeVodURL resp:", err)
+	}
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("io.ReadAll:", err)
+	}
+	want := string(content[:bootLen]) + string(content[bootLen:])
+	if string(got) != want {
+		t.Fatalf("boot split body = %q, want %q", got, want)
+	}
+}
+
+func TestQcdn_CacheHitAvoidsOrigin(t *testing.T) {
+	content := []byte("0123456789ABCDEFGHIJ") // 20 bytes
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write(content)
+	}))
+	defer origin.Close()
+	log.Println("origin.URL:", origin.URL)
+
+	proxy := NewQcdnProxy(&QcdnConfig{Cache: cache.NewFS(t.TempDir(), 0)})
+	defer proxy.Close()
+
+	proxy.SetStrategy(origin.URL, &QcdnStrategy{
+		Backups: []string{"http://not-exist.com"},
+	})
+
+	url := proxy.MakeVodURL(origin.URL+"/video.mp4", 0)
+	log.Println("proxy.MakeVodURL:", url)
+
+	resp, err := http.Get(url)
+	checkHttpResp(t, resp, err, 200, string(content))
+
+	// 给缓存写入的后台 goroutine 一点时间完成 rename，再发第二次请求验证命中。
+	time.Sleep(50 * time.Millisecond)
+
+	resp, err = http.Get(url)
+	checkHttpResp(t, resp, err, 200, string(content))
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("origin hit count = %d, want 1 (second request should be served from cache)", hits)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=5-9")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("cached Range GET status = %d, want 206", resp.StatusCode)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := string(content[5:10]); string(got) != want {
+		t.Fatalf("cached Range GET body = %q, want %q", got, want)
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("origin hit count = %d, want 1 (range request should be served from cache)", hits)
+	}
+}
+
+func TestQcdn_ActiveHealthCheckOpensBreaker(t *testing.T) {
+	var failing int32
+	var primaryGETs int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			if atomic.LoadInt32(&failing) != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		atomic.AddInt32(&primaryGETs, 1)
+		io.WriteString(w, "primary")
+	}))
+	defer primary.Close()
+	log.Println("primary.URL:", primary.URL)
+
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "backup")
+	}))
+	defer backup.Close()
+	log.Println("backup.URL:", backup.URL)
+
+	proxy := NewQcdnProxy(&QcdnConfig{
+		HealthCheckInterval:  20 * time.Millisecond,
+		BreakerFailThreshold: 1,
+		BreakerOpenTimeout:   time.Hour, // 测试期间不需要它自己恢复
+	})
+	defer proxy.Close()
+
+	proxy.SetStrategy(primary.URL, &QcdnStrategy{
+		Backups: []string{backup.URL},
+	})
+
+	url := proxy.MakeVodURL(primary.URL+"/hello", 0)
+	log.Println("proxy.MakeVodURL:", url)
+
+	resp, err := http.Get(url)
+	checkHttpResp(t, resp, err, 200, "primary")
+	if primaryGETs != 1 {
+		t.Fatalf("primaryGETs = %d, want 1 before toggling failing", primaryGETs)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(50 * time.Millisecond) // 给后台探测 goroutine 至少一个周期去把 primary 标记为 open
+
+	base := primary.URL // 恰好和 OriginStats 里 "scheme://host" 的 key 格式一致
+	if state := proxy.OriginStats()[base].State; state != "open" {
+		t.Fatalf("OriginStats()[%q].State = %q, want \"open\"", base, state)
+	}
+
+	resp, err = http.Get(url)
+	checkHttpResp(t, resp, err, 200, "backup")
+	if primaryGETs != 1 {
+		t.Fatalf("primaryGETs = %d, want still 1 (request should bypass the open breaker)", primaryGETs)
+	}
+}
+
+func TestQcdn_FailoverSkipsOpenBreakerBackup(t *testing.T) {
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+		io.WriteString(w, "fail")
+	}))
+	defer fail.Close()
+	log.Println("fail.URL:", fail.URL)
+
+	var failingBackup int32
+	var backupAGETs int32
+	backupA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			if atomic.LoadInt32(&failingBackup) != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		atomic.AddInt32(&backupAGETs, 1)
+		io.WriteString(w, "backupA")
+	}))
+	defer backupA.Close()
+	log.Println("backupA.URL:", backupA.URL)
+
+	backupB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "backupB")
+	}))
+	defer backupB.Close()
+	log.Println("backupB.URL:", backupB.URL)
+
+	proxy := NewQcdnProxy(&QcdnConfig{
+		HealthCheckInterval:  20 * time.Millisecond,
+		BreakerFailThreshold: 1,
+		BreakerOpenTimeout:   time.Hour, // 测试期间不需要它自己恢复
+	})
+	defer proxy.Close()
+
+	proxy.SetStrategy(fail.URL, &QcdnStrategy{
+		Backups: []string{backupA.URL, backupB.URL},
+	})
+
+	url := proxy.MakeVodURL(fail.URL+"/hello", 0)
+	log.Println("proxy.MakeVodURL:", url)
+
+	atomic.StoreInt32(&failingBackup, 1)
+	time.Sleep(50 * time.Millisecond) // 给后台探测 goroutine 至少一个周期去把 backupA 标记为 open
+
+	// 主域名一直失败，第一次请求要走 popCandidate 选 backup；backupA 的熔断器已经 open，
+	// 不应该被选中浪费一次往返，于是落到 backupB 并被缓存为 redirect，后续请求直接走
+	// backupB。所有请求都应该落到 backupB。
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(url)
+		checkHttpResp(t, resp, err, 200, "backupB")
+	}
+	if backupAGETs != 0 {
+		t.Fatalf("backupAGETs = %d, want 0 (failover should skip the open-breaker backup)", backupAGETs)
+	}
+}
+
+func TestQcdn_MetricsRecordRequestsAndRedirects(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.URL.Path)
+	}))
+	defer echo.Close()
+	log.Println("echo.URL:", echo.URL)
+
+	first := true
+	s302 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if first {
+			http.Redirect(w, req, echo.URL+"/302", http.StatusFound)
+			first = false
+		} else {
+			io.WriteString(w, "/unexpected")
+		}
+	}))
+	defer s302.Close()
+	log.Println("302.URL:", s302.URL)
+
+	metrics := newFakeMetrics()
+	proxy := NewQcdnProxy(&QcdnConfig{Metrics: metrics})
+	defer proxy.Close()
+
+	proxy.SetStrategy(s302.URL, &QcdnStrategy{
+		Backups: []string{"http://not-exist.com"},
+	})
+
+	url := proxy.MakeVodURL(s302.URL+"/hello", 0)
+	log.Println("proxy.MakeVodURL:", url)
+
+	resp, err := http.Get(url)
+	checkHttpResp(t, resp, err, 200, "/302")
+
+	if n := metrics.redirectCacheSize(); n != 1 {
+		t.Fatalf("RedirectCacheSize = %d, want 1 after following a redirect", n)
+	}
+	if n := metrics.requestsFor(echo.URL[len("http://"):], "200"); n != 1 {
+		t.Fatalf("RequestsTotal[echo,200] = %d, want 1", n)
+	}
+	if n := metrics.failoverCount(); n != 1 {
+		t.Fatalf("FailoverTotal = %d, want 1 (the 302 counted as a failover to the redirect target)", n)
+	}
+}
+
+// fakeMetrics 是测试用的 Metrics 实现，记录每个 call 的次数方便断言。
+type fakeMetrics struct {
+	mu        sync.Mutex
+	requests  map[string]int
+	failovers int
+	redirSize int
+}
+
+func newFakeMetrics() *fakeMetrics { return &fakeMetrics{requests: make(map[string]int)} }
+
+func (m *fakeMetrics) IncRequestsTotal(origin, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[origin+","+status]++
+}
+
+func (m *fakeMetrics) ObserveUpstreamLatency(origin string, d time.Duration) {}
+
+func (m *fakeMetrics) IncFailoverTotal(from, to string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failovers++
+}
+
+func (m *fakeMetrics) SetRedirectCacheSize(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.redirSize = n
+}
+
+func (m *fakeMetrics) requestsFor(origin, status string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests[origin+","+status]
+}
+
+func (m *fakeMetrics) failoverCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failovers
+}
+
+func (m *fakeMetrics) redirectCacheSize() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.redirSize
+}
+
+// rangeEchoHandler 模拟一个支持 Range 请求的源站，没有 Range 头时返回整个 content。
+func rangeEchoHandler(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rh := req.Header.Get("Range")
+		if rh == "" {
+			w.Write(content)
+			return
+		}
+		start, end, ok := parseTestRange(rh, len(content))
+		if !ok {
+			http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : end+1])
+	}
+}
+
+func parseTestRange(h string, total int) (start, end int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(h, prefix) {
+		return
+	}
+	parts := strings.SplitN(h[len(prefix):], "-", 2)
+	if len(parts) != 2 {
+		return
+	}
+	s, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return
+	}
+	e := int64(total) - 1
+	if parts[1] != "" {
+		e, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	return s, e, true
+}
+
 func checkHttpResp(t *testing.T, resp *http.Response, err error, code int, body string) {
 	t.Helper()
 	if err != nil {
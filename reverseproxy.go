@@ -0,0 +1,218 @@
+package qcdn
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxProxyHops 限制一次客户端请求在 3xx 跟随 + backup failover 总共能经过多少跳，
+// 避免源站间互相重定向形成死循环。
+const maxProxyHops = 10
+
+// failoverSignal 由 ModifyResponse 构造并通过 error 返回，驱动 ErrorHandler 决定下一步
+// 尝试谁：要么是当前响应里 3xx 给出的重定向目标（next 非零值），要么是 remaining 中
+// 按健康度选出的下一个 backup。
+type failoverSignal struct {
+	next      resource
+	remaining []urlBase
+	cache     bool // 命中 next/下一个 backup 成功后，是否要 setRedirect 缓存
+}
+
+func (*failoverSignal) Error() string { return "qcdn: origin rejected, failing over" }
+
+// attemptOrigin 用 httputil.ReverseProxy 把 req 转发给 target，利用 Director 改写目标、
+// ModifyResponse 判断是否需要继续 failover、ErrorHandler 驱动重试，从而把 3xx 跟随和
+// 多 backup failover 都统一成对同一个 ResponseWriter 的递归尝试。底层转发是流式的：
+// ReverseProxy 直接把上游的 body 拷给 w（按 FlushInterval 刷新），不会把整个响应缓存
+// 在内存里，客户端断开时 req.Context() 被取消，上游请求也会随之中止。
+func (p *QcdnProxy) attemptOrigin(w http.ResponseWriter, req *http.Request, uri, target resource, remaining []urlBase, cacheOnSuccess bool, hopsLeft int) {
+	start := time.Now()
+	timings := new(traceTimings)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timings.clientTrace()))
+	rp := &httputil.ReverseProxy{
+		Transport: p.client.Transport,
+		Director: func(r *http.Request) {
+			r.URL.Scheme = target.scheme
+			r.URL.Host = target.host
+			r.URL.Path = target.path
+			r.Host = target.host
+		},
+		FlushInterval: 200 * time.Millisecond,
+		ModifyResponse: func(resp *http.Response) error {
+			latency := time.Since(start)
+			p.metrics.ObserveUpstreamLatency(target.host, latency)
+			p.metrics.IncRequestsTotal(target.host, strconv.Itoa(resp.StatusCode))
+			p.logger.Debugf("attemptOrigin: origin=%s status=%d latency=%s dns=%s connect=%s tls=%s ttfb=%s",
+				target.host, resp.StatusCode, latency, timings.dns(), timings.connect(), timings.tls(), timings.ttfb(start))
+			if isRedirectStatus(resp.StatusCode) {
+				resp.Body.Close()
+				if next, ok := parseResourceURL(resp.Header.Get("Location")); ok && hopsLeft > 1 {
+					return &failoverSignal{next: next, remaining: remaining, cache: true}
+				}
+				p.health.Observe(target.urlBase, latency, resp.StatusCode, nil)
+				return &failoverSignal{remaining: remaining, cache: true}
+			}
+			p.health.Observe(target.urlBase, latency, resp.StatusCode, nil)
+			if shouldFailover(resp) {
+				resp.Body.Close()
+				return &failoverSignal{remaining: remaining, cache: true}
+			}
+			if cacheOnSuccess && target != uri {
+				p.setRedirect(uri, target)
+			}
+			if p.cache != nil && cacheableResponse(req.Method, resp) {
+				resp.Body = p.teeToCache(cacheKeyOf(uri), resp)
+			}
+			return nil
+		},
+		ErrorHandler: func(ew http.ResponseWriter, er *http.Request, err error) {
+			sig, ok := err.(*failoverSignal)
+			if !ok {
+				latency := time.Since(start)
+				p.metrics.ObserveUpstreamLatency(target.host, latency)
+				p.metrics.IncRequestsTotal(target.host, "error")
+				p.logger.Warnf("attemptOrigin: origin=%s error=%v latency=%s", target.host, err, latency)
+				p.health.Observe(target.urlBase, latency, 0, err)
+				sig = &failoverSignal{remaining: remaining, cache: true}
+			}
+			if hopsLeft <= 1 {
+				http.Error(ew, "too many redirects/failovers", http.StatusBadGateway)
+				return
+			}
+			if sig.next != (resource{}) {
+				p.logger.Infof("attemptOrigin: decision=backup reason=redirect origin=%s next=%s", target.host, sig.next.host)
+				p.metrics.IncFailoverTotal(target.host, sig.next.host)
+				p.attemptOrigin(ew, er, uri, sig.next, sig.remaining, sig.cache, hopsLeft-1)
+				return
+			}
+			next, rest, ok := p.popCandidate(sig.remaining)
+			if !ok {
+				http.Error(ew, "all origins failed", http.StatusBadGateway)
+				return
+			}
+			p.logger.Infof("attemptOrigin: decision=backup reason=failover origin=%s next=%s", target.host, next.host)
+			p.metrics.IncFailoverTotal(target.host, next.host)
+			p.attemptOrigin(ew, er, uri, resource{next, uri.path}, rest, true, hopsLeft-1)
+		},
+	}
+	rp.ServeHTTP(w, req)
+}
+
+// popCandidate 用健康策略从 remaining 中选出下一个要尝试的 backup，并返回去掉它之后
+// 剩下的候选列表。先用主动探测的熔断器剔除已经 open 的 origin，再把剩下的交给
+// health.Pick 做被动 EWMA 打分，这样每一跳 failover 都结合两种健康信号，不会把流量
+// 浪费在一个已知跳闸的 origin 上。
+func (p *QcdnProxy) popCandidate(remaining []urlBase) (pick urlBase, rest []urlBase, ok bool) {
+	if len(remaining) == 0 {
+		return urlBase{}, nil, false
+	}
+	candidates := remaining
+	if closed := p.filterBreakerClosed(remaining); len(closed) > 0 {
+		candidates = closed
+	}
+	pick = p.health.Pick(candidates)
+	return pick, removeBase(remaining, pick), true
+}
+
+// filterBreakerClosed 去掉 candidates 里主动探测熔断器已经 open 的 origin；全部都
+// open 时返回空切片，调用方退化为在原始列表里打分，驱动其中一个的健康状态更新。
+func (p *QcdnProxy) filterBreakerClosed(candidates []urlBase) []urlBase {
+	out := make([]urlBase, 0, len(candidates))
+	for _, c := range candidates {
+		if !p.breakerOpen(c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// removeBase 返回去掉 b 之后的 candidates，供 failover 循环排除已经试过的 origin。
+func removeBase(candidates []urlBase, b urlBase) []urlBase {
+	out := candidates[:0]
+	for _, c := range candidates {
+		if c != b {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// shouldFailover 判断一个已经成功发起（无 transport 错误）的响应是否仍然要被当成
+// 失败处理：5xx、带 Retry-After 的响应，或者声称 200 却是空包的可疑响应。
+func shouldFailover(resp *http.Response) bool {
+	if resp.StatusCode/100 == 5 {
+		return true
+	}
+	if resp.Header.Get("Retry-After") != "" {
+		return true
+	}
+	if resp.StatusCode == http.StatusOK && resp.ContentLength == 0 {
+		return true
+	}
+	return false
+}
+
+func isRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// parseResourceURL 把 Location 头解析成 resource，用于跟随 3xx 重定向。
+func parseResourceURL(location string) (resource, bool) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return resource{}, false
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return resource{urlBase{u.Scheme, u.Host}, path}, true
+}
+
+// traceTimings 用 httptrace.ClientTrace 收集单次上游请求的 DNS/connect/TLS/首字节
+// 时间点，喂给 Logger 和 Metrics 做可观测性用。一个 traceTimings 只服务于一次
+// attemptOrigin 调用，不需要加锁。
+type traceTimings struct {
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+}
+
+func (t *traceTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { t.connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { t.connectDone = time.Now() },
+		TLSHandshakeStart:    func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.tlsDone = time.Now() },
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+}
+
+func (t *traceTimings) dns() time.Duration     { return durationBetween(t.dnsStart, t.dnsDone) }
+func (t *traceTimings) connect() time.Duration { return durationBetween(t.connectStart, t.connectDone) }
+func (t *traceTimings) tls() time.Duration     { return durationBetween(t.tlsStart, t.tlsDone) }
+func (t *traceTimings) ttfb(reqStart time.Time) time.Duration {
+	return durationBetween(reqStart, t.firstByte)
+}
+
+// durationBetween 在 start/end 任一为零值时返回 0，避免把"没发生过"（比如走复用连接
+// 不会有 ConnectStart/Done）误报成一个巨大的负数或者 0 值时长之外的噪声。
+func durationBetween(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}